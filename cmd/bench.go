@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// BenchStats collects per-chunk transfer latencies for a benchmark run in a
+// fixed-size ring buffer, and derives percentile and throughput statistics
+// from them at teardown.
+type BenchStats struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	next      int
+	full      bool
+}
+
+// NewBenchStats returns a BenchStats with room for capacity chunk timings.
+func NewBenchStats(capacity int) *BenchStats {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &BenchStats{latencies: make([]time.Duration, capacity)}
+}
+
+// Record adds a chunk's transfer latency to the ring buffer, overwriting the
+// oldest entry once capacity is reached.
+func (b *BenchStats) Record(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.latencies[b.next] = d
+	b.next = (b.next + 1) % len(b.latencies)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+func (b *BenchStats) samples() []time.Duration {
+	if b.full {
+		return b.latencies
+	}
+	return b.latencies[:b.next]
+}
+
+// BenchSummary is the machine-readable result of a benchmark run, suitable
+// for diffing across runs when emitted as JSON.
+type BenchSummary struct {
+	Chunks      int     `json:"chunks"`
+	ChunkSize   int     `json:"chunk_size_bytes"`
+	Duration    float64 `json:"duration_seconds"`
+	P50Millis   float64 `json:"p50_ms"`
+	P90Millis   float64 `json:"p90_ms"`
+	P99Millis   float64 `json:"p99_ms"`
+	P999Millis  float64 `json:"p999_ms"`
+	MinMBPerSec float64 `json:"min_mb_per_sec"`
+	MaxMBPerSec float64 `json:"max_mb_per_sec"`
+	AvgMBPerSec float64 `json:"avg_mb_per_sec"`
+	StdDevMBps  float64 `json:"stddev_mb_per_sec"`
+}
+
+// Summarize sorts the recorded latencies and derives percentile and
+// throughput statistics from them.
+func (b *BenchStats) Summarize(chunkSize int, elapsed time.Duration) BenchSummary {
+	b.mu.Lock()
+	samples := append([]time.Duration(nil), b.samples()...)
+	b.mu.Unlock()
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+	throughputs := make([]float64, len(samples))
+	var sum float64
+	for i, d := range samples {
+		mbps := (float64(chunkSize) / (1024 * 1024)) / d.Seconds()
+		throughputs[i] = mbps
+		sum += mbps
+	}
+
+	var min, max, mean float64
+	if len(throughputs) > 0 {
+		min, max = throughputs[0], throughputs[0]
+		for _, t := range throughputs {
+			if t < min {
+				min = t
+			}
+			if t > max {
+				max = t
+			}
+		}
+		mean = sum / float64(len(throughputs))
+	}
+
+	var variance float64
+	for _, t := range throughputs {
+		variance += (t - mean) * (t - mean)
+	}
+	if len(throughputs) > 0 {
+		variance /= float64(len(throughputs))
+	}
+
+	return BenchSummary{
+		Chunks:      len(samples),
+		ChunkSize:   chunkSize,
+		Duration:    elapsed.Seconds(),
+		P50Millis:   percentile(samples, 0.50),
+		P90Millis:   percentile(samples, 0.90),
+		P99Millis:   percentile(samples, 0.99),
+		P999Millis:  percentile(samples, 0.999),
+		MinMBPerSec: min,
+		MaxMBPerSec: max,
+		AvgMBPerSec: mean,
+		StdDevMBps:  math.Sqrt(variance),
+	}
+}
+
+// percentile returns the p-th percentile (0..1) latency in milliseconds from
+// a pre-sorted slice of durations.
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(p * float64(len(sorted)))
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return float64(sorted[idx]) / float64(time.Millisecond)
+}
+
+// benchCommand builds the `bw bench` subcommand, which runs a fixed synthetic
+// workload and reports latency percentiles and throughput statistics rather
+// than the continuous meter the root command prints.
+func benchCommand() *cli.Command {
+	var (
+		count       int
+		size        int
+		duration    time.Duration
+		concurrency int
+		asJSON      bool
+	)
+
+	return &cli.Command{
+		Name:  "bench",
+		Usage: "run a fixed workload and report latency percentiles and throughput stats",
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:        "count",
+				Usage:       "number of chunks to transfer",
+				Value:       1000,
+				Destination: &count,
+			},
+			&cli.IntFlag{
+				Name:        "size",
+				Usage:       "size of each chunk in bytes",
+				Value:       1024 * 1024,
+				Destination: &size,
+			},
+			&cli.DurationFlag{
+				Name:        "duration",
+				Usage:       "stop the benchmark after this long, overriding --count",
+				Destination: &duration,
+			},
+			&cli.IntFlag{
+				Name:        "concurrency",
+				Usage:       "number of parallel workers transferring chunks",
+				Value:       1,
+				Destination: &concurrency,
+			},
+			&cli.BoolFlag{
+				Name:        "json",
+				Usage:       "emit the summary as JSON instead of a human readable report",
+				Destination: &asJSON,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			return runBench(count, size, duration, concurrency, asJSON)
+		},
+	}
+}
+
+// defaultBenchCapacity sizes the BenchStats ring buffer when --duration
+// governs the run instead of --count, since there's no fixed chunk total to
+// size it from up front.
+const defaultBenchCapacity = 100000
+
+// runBench generates a synthetic workload of size-byte chunks, spread
+// across concurrency worker goroutines that all feed the same readCounter
+// channel, recording each chunk's transfer latency into a BenchStats ring
+// buffer. With duration set, each worker keeps generating chunks until the
+// deadline, overriding count entirely; otherwise count is divided evenly
+// across workers, with the remainder given to the first few so the total
+// still adds up to exactly count. It reports the resulting percentile and
+// throughput summary once the workload completes.
+func runBench(count, size int, duration time.Duration, concurrency int, asJSON bool) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	statsCapacity := count
+	if duration > 0 {
+		statsCapacity = defaultBenchCapacity
+	}
+	stats := NewBenchStats(statsCapacity)
+	readCounter := make(chan Sample)
+	defer close(readCounter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+
+	go func() {
+		for range readCounter {
+		}
+	}()
+
+	chunk := make([]byte, size)
+	chunksPerWorker := count / concurrency
+	remainder := count % concurrency
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < concurrency; w++ {
+		workerChunks := chunksPerWorker
+		if w < remainder {
+			// count doesn't divide evenly across workers; give the leftover
+			// chunks to the first few workers so the total still adds up to
+			// exactly count instead of silently dropping them.
+			workerChunks++
+		}
+
+		wg.Add(1)
+		go func(workerChunks int) {
+			defer wg.Done()
+			for i := 0; duration > 0 || i < workerChunks; i++ {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+
+				chunkStart := time.Now()
+				n, err := io.CopyN(ioutil.Discard, bytes.NewReader(chunk), int64(len(chunk)))
+				if err != nil {
+					return
+				}
+				stats.Record(time.Since(chunkStart))
+				readCounter <- Sample{ConnID: "bench", N: n}
+			}
+		}(workerChunks)
+	}
+	wg.Wait()
+
+	summary := stats.Summarize(size, time.Since(start))
+
+	if asJSON {
+		return json.NewEncoder(os.Stdout).Encode(summary)
+	}
+
+	fmt.Printf("chunks: %d, chunk size: %d bytes, duration: %.2fs\n",
+		summary.Chunks, summary.ChunkSize, summary.Duration)
+	fmt.Printf("latency  p50=%.3fms p90=%.3fms p99=%.3fms p999=%.3fms\n",
+		summary.P50Millis, summary.P90Millis, summary.P99Millis, summary.P999Millis)
+	fmt.Printf("throughput  min=%.2f MB/s max=%.2f MB/s avg=%.2f MB/s stddev=%.2f MB/s\n",
+		summary.MinMBPerSec, summary.MaxMBPerSec, summary.AvgMBPerSec, summary.StdDevMBps)
+	return nil
+}
@@ -6,16 +6,23 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/urfave/cli/v2"
+	"golang.org/x/time/rate"
 )
 
 const (
-	nextStep = 1024
+	nextStep  = 1024
+	chunkSize = nextStep * nextStep
 )
 
 type (
@@ -23,6 +30,14 @@ type (
 		count float64
 		desc  string
 	}
+
+	// Sample is a single bandwidth reading attributed to the connection (or
+	// source) it was read from, so CalculateBandwidth can report both the
+	// global average and per-connection subtotals.
+	Sample struct {
+		ConnID string
+		N      int64
+	}
 )
 
 var (
@@ -38,15 +53,25 @@ var (
 
 func main() {
 	var (
-		socket string
-		port   int
-		src    io.Reader
-		mb     int
+		socket          string
+		port            int
+		proto           string
+		src             io.Reader
+		mb              int
+		limit           string
+		burst           string
+		out             string
+		noMeasureWrites bool
+		metricsAddr     string
+		statsdAddr      string
 	)
 
 	app := &cli.App{
 		Name:  "bw",
 		Usage: "Measure data bandwidth through a socket or port.",
+		Commands: []*cli.Command{
+			benchCommand(),
+		},
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:        "file",
@@ -63,9 +88,15 @@ func main() {
 			&cli.IntFlag{
 				Name:        "port",
 				Aliases:     []string{"p"},
-				Usage:       "port to read data from",
+				Usage:       "port to listen on and read data from",
 				Destination: &port,
 			},
+			&cli.StringFlag{
+				Name:        "proto",
+				Usage:       "protocol to listen with when --port is set, tcp or udp",
+				Value:       "tcp",
+				Destination: &proto,
+			},
 			&cli.IntFlag{
 				Name:        "mb",
 				Aliases:     []string{"m"},
@@ -73,6 +104,37 @@ func main() {
 				Destination: &mb,
 				DefaultText: "1",
 			},
+			&cli.StringFlag{
+				Name:        "limit",
+				Usage:       "cap read throughput, e.g. 10MB/s, 1.5GB/s",
+				Destination: &limit,
+			},
+			&cli.StringFlag{
+				Name:        "burst",
+				Usage:       "token bucket burst size, e.g. 10MB (defaults to --limit, or 1MB if --limit is smaller)",
+				Destination: &burst,
+			},
+			&cli.StringFlag{
+				Name:        "out",
+				Aliases:     []string{"o"},
+				Usage:       "where to tee read data, a file path, -, tcp://host:port, or unix:///path (defaults to discarding it)",
+				Destination: &out,
+			},
+			&cli.BoolFlag{
+				Name:        "no-measure-writes",
+				Usage:       "measure throughput from the source only, decoupled from --out write speed",
+				Destination: &noMeasureWrites,
+			},
+			&cli.StringFlag{
+				Name:        "metrics-addr",
+				Usage:       "address to serve Prometheus metrics on, e.g. :9090",
+				Destination: &metricsAddr,
+			},
+			&cli.StringFlag{
+				Name:        "statsd",
+				Usage:       "host:port of a StatsD daemon to push metrics to",
+				Destination: &statsdAddr,
+			},
 		},
 		Action: func(c *cli.Context) error {
 			// validate the filetype
@@ -82,6 +144,9 @@ func main() {
 			if port != 0 && socket != "" {
 				return fmt.Errorf("must only specify either a port, socket, or be writing to stdin")
 			}
+			if proto != "tcp" && proto != "udp" {
+				return fmt.Errorf("proto must be either tcp or udp")
+			}
 
 			if isStdin() {
 				src = os.Stdin
@@ -91,7 +156,39 @@ func main() {
 				mb = 1
 			}
 
-			return nil
+			var limiter *rate.Limiter
+			if limit != "" {
+				limitBytes, err := parseSize(limit)
+				if err != nil {
+					return fmt.Errorf("invalid --limit: %v", err)
+				}
+
+				burstBytes := limitBytes
+				if burst != "" {
+					burstBytes, err = parseSize(burst)
+					if err != nil {
+						return fmt.Errorf("invalid --burst: %v", err)
+					}
+				} else if burstBytes < int64(chunkSize) {
+					// ReadData reads up to chunkSize at a time; with no
+					// --burst given, keep the bucket at least that deep so a
+					// full read is charged in a single WaitN call rather than
+					// being split into burst-sized pieces by waitLimiter.
+					burstBytes = int64(chunkSize)
+				}
+
+				limiter = rate.NewLimiter(rate.Limit(limitBytes), int(burstBytes))
+			}
+
+			sink, sinkCloser, err := openSink(out)
+			if err != nil {
+				return fmt.Errorf("invalid --out: %v", err)
+			}
+			if sinkCloser != nil {
+				defer sinkCloser.Close()
+			}
+
+			return meter(socket, port, proto, src, mb, limiter, sink, sinkCloser, !noMeasureWrites, metricsAddr, statsdAddr)
 		},
 		Authors: []*cli.Author{
 			&cli.Author{
@@ -101,14 +198,30 @@ func main() {
 		},
 	}
 
-	err := app.Run(os.Args)
-	if err != nil {
+	if err := app.Run(os.Args); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	// channel for sending bytes read to the counter
-	readCounter := make(chan int64)
+	os.Exit(0)
+	return
+}
+
+// meter wires up the read counter and bandwidth calculator and then reads
+// from whichever source was selected (a listening port, a unix socket, or
+// stdin). A listener runs until ctx is cancelled by a signal; stdin is read
+// until EOF, after which meter returns without waiting for one. If the
+// reader fails, meter blocks until the signal and returns nil. limiter may be nil,
+// in which case reads are unthrottled. Every byte read is teed to sink;
+// measureWrites controls whether the time spent writing to sink counts
+// toward the measured throughput. sinkCloser is sink's io.Closer when it has
+// one (nil for shared stdio handles or a discarded sink), and is closed to
+// unblock a sink stuck mid-Write once ctx is cancelled. When metricsAddr or
+// statsdAddr is set, every sample is additionally fanned out to a
+// Prometheus registry or a StatsD pusher alongside the stdout printer.
+func meter(socket string, port int, proto string, src io.Reader, mb int, limiter *rate.Limiter, sink io.Writer, sinkCloser io.Closer, measureWrites bool, metricsAddr, statsdAddr string) error {
+	// channel producers send bytes-read samples to
+	readCounter := make(chan Sample)
 	defer close(readCounter)
 
 	// context passed into reader and calculater
@@ -123,14 +236,43 @@ func main() {
 		cancel()
 	}()
 
-	// run the main read and count loops
-	go CalculateBandwidth(ctx, readCounter)
-	if err := ReadData(ctx, readCounter, src, mb); err != nil {
+	// every consumer gets its own channel, fed by fanOut, so the stdout
+	// printer, the Prometheus registry, and the StatsD pusher each see
+	// every sample without racing over readCounter directly
+	printerCh := make(chan Sample)
+	consumers := []chan Sample{printerCh}
+	go CalculateBandwidth(ctx, printerCh)
+
+	if metricsAddr != "" {
+		metricsCh := make(chan Sample)
+		consumers = append(consumers, metricsCh)
+		reg := newMetricsRegistry()
+		go reg.consume(ctx, metricsCh)
+		go reg.serve(ctx, metricsAddr)
+	}
+
+	if statsdAddr != "" {
+		statsdCh := make(chan Sample)
+		consumers = append(consumers, statsdCh)
+		go pushStatsd(ctx, statsdCh, statsdAddr)
+	}
+
+	go fanOut(ctx, readCounter, consumers...)
+
+	var err error
+	switch {
+	case port != 0:
+		err = Listen(ctx, readCounter, proto, port, mb, limiter, sink, sinkCloser, measureWrites)
+	case socket != "":
+		err = ListenUnix(ctx, readCounter, socket, mb, limiter, sink, sinkCloser, measureWrites)
+	default:
+		err = ReadData(ctx, readCounter, src, mb, "stdin", limiter, sink, sinkCloser, measureWrites)
+	}
+	if err != nil {
 		<-ctx.Done()
 	}
 
-	os.Exit(0)
-	return
+	return nil
 }
 
 // isStdin returns true when file has data piped from stdin.
@@ -139,41 +281,310 @@ func isStdin() bool {
 	return (stat.Mode() & os.ModeCharDevice) == 0
 }
 
-// ReadData reads from the pipe.Reader(), sending the amount of bytes read to bRead,
-// and writing the bytes to the pipe.Writer(). If no data can be read, the function
-// will exit and cxt will be cancelled.
-func ReadData(ctx context.Context, bRead chan int64, src io.Reader, r int) error {
+// Listen opens a listening socket on port using the given network protocol
+// ("tcp" or "udp") and measures the aggregate bandwidth across every
+// connection accepted on it. Each accepted tcp connection is read on its
+// own goroutine, keyed by remote address, so CalculateBandwidth can break
+// down throughput per connection as well as in aggregate. Every connection
+// tees its bytes to the same sink. Listen waits for every spawned
+// connection goroutine to finish before returning, so the caller can safely
+// close bRead once Listen is done.
+func Listen(ctx context.Context, bRead chan Sample, proto string, port int, mb int, limiter *rate.Limiter, sink io.Writer, sinkCloser io.Closer, measureWrites bool) error {
+	addr := fmt.Sprintf(":%d", port)
+
+	if proto == "udp" {
+		return readPacketConn(ctx, bRead, "udp", addr, mb, limiter, sink, sinkCloser, measureWrites)
+	}
+
+	ln, err := net.Listen(proto, addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+				return err
+			}
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			ReadData(ctx, bRead, conn, mb, conn.RemoteAddr().String(), limiter, sink, sinkCloser, measureWrites)
+		}()
+	}
+}
+
+// ListenUnix opens a listening unix socket at path and measures the
+// aggregate bandwidth across every connection accepted on it, in the same
+// manner as Listen does for tcp. Like Listen, it waits for every spawned
+// connection goroutine to finish before returning.
+func ListenUnix(ctx context.Context, bRead chan Sample, path string, mb int, limiter *rate.Limiter, sink io.Writer, sinkCloser io.Closer, measureWrites bool) error {
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for i := 0; ; i++ {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+				return err
+			}
+		}
+
+		connID := fmt.Sprintf("%s#%d", path, i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			ReadData(ctx, bRead, conn, mb, connID, limiter, sink, sinkCloser, measureWrites)
+		}()
+	}
+}
 
-	// ensure the reader is buffered for performance
+// readPacketConn reads datagrams from a connectionless packet socket bound
+// to addr, attributing every datagram to addr since there is no accept loop
+// to distinguish individual peers. Unlike ReadData it has no ring buffer to
+// apply backpressure with, so each datagram is throttled and teed to sink
+// synchronously before the next one is read. sinkCloser is sink's io.Closer
+// when it has one (nil for shared stdio handles or a discarded sink).
+func readPacketConn(ctx context.Context, bRead chan Sample, network, addr string, mb int, limiter *rate.Limiter, sink io.Writer, sinkCloser io.Closer, measureWrites bool) error {
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+		if sinkCloser != nil {
+			sinkCloser.Close()
+		}
+	}()
+
+	buf := make([]byte, nextStep*nextStep*mb)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+				return err
+			}
+		}
+
+		if n > 0 {
+			if limiter != nil {
+				if werr := waitLimiter(ctx, limiter, n); werr != nil {
+					return werr
+				}
+			}
+
+			if !measureWrites {
+				bRead <- Sample{ConnID: addr, N: int64(n)}
+			}
+
+			if _, werr := sink.Write(buf[:n]); werr != nil {
+				return werr
+			}
+
+			if measureWrites {
+				bRead <- Sample{ConnID: addr, N: int64(n)}
+			}
+		}
+	}
+}
+
+// waitLimiter waits for permission to send n bytes through limiter,
+// splitting the request into limiter's burst-sized pieces first. WaitN
+// rejects any single call larger than the configured burst outright, and a
+// caller's read chunk (e.g. ReadData's chunkSize) can exceed a user-supplied
+// --burst, so charging it in one call would abort the transfer instead of
+// throttling it.
+func waitLimiter(ctx context.Context, limiter *rate.Limiter, n int) error {
+	burst := limiter.Burst()
+	if burst <= 0 {
+		burst = n
+	}
+	for n > 0 {
+		take := n
+		if take > burst {
+			take = burst
+		}
+		if err := limiter.WaitN(ctx, take); err != nil {
+			return err
+		}
+		n -= take
+	}
+	return nil
+}
+
+// ReadData pulls bytes from src into a bounded RingBuffer on its own
+// producer goroutine, and drains the ring into sink on the calling
+// goroutine, so a slow sink applies backpressure without stalling the
+// measurement of how fast src itself is producing data. --mb controls the
+// ring's capacity. connID identifies the source of src so CalculateBandwidth
+// can surface per-connection subtotals. When limiter is non-nil, reads from
+// src are throttled to its configured rate. When measureWrites is false, a
+// sample is sent as soon as bytes are off src, before the producer's Write
+// into the ring can block on backpressure, so a slow sink doesn't skew the
+// measured throughput. sinkCloser is sink's io.Closer when it has one (nil
+// for shared stdio handles or a discarded sink).
+func ReadData(ctx context.Context, bRead chan Sample, src io.Reader, r int, connID string, limiter *rate.Limiter, sink io.Writer, sinkCloser io.Closer, measureWrites bool) error {
 	bufSrc := bufio.NewReader(src)
-	bin := bufio.NewWriter(ioutil.Discard)
-	rw := bufio.NewReadWriter(bufSrc, bin)
+	capacity := chunkSize * r
+	if capacity < chunkSize {
+		capacity = chunkSize
+	}
+	ring := NewRingBuffer(capacity)
+
+	// unblock the producer and consumer the instant ctx is cancelled: a
+	// closed ring wakes anyone parked in Read/Write on it, and closing
+	// sinkCloser (when sink is closeable and isn't a shared stdio handle,
+	// e.g. a tcp/unix --out connection) unblocks a Write that's stuck on a
+	// stalled destination.
+	go func() {
+		<-ctx.Done()
+		ring.CloseWithError(ctx.Err())
+		if sinkCloser != nil {
+			sinkCloser.Close()
+		}
+	}()
 
+	go func() {
+		buf := make([]byte, chunkSize)
+		for {
+			select {
+			case <-ctx.Done():
+				ring.CloseWithError(ctx.Err())
+				return
+			default:
+			}
+
+			n, err := bufSrc.Read(buf)
+			if n > 0 {
+				if limiter != nil {
+					if werr := waitLimiter(ctx, limiter, n); werr != nil {
+						ring.CloseWithError(werr)
+						return
+					}
+				}
+
+				if !measureWrites {
+					bRead <- Sample{ConnID: connID, N: int64(n)}
+				}
+
+				if _, werr := ring.Write(buf[:n]); werr != nil {
+					ring.CloseWithError(werr)
+					return
+				}
+
+				if measureWrites {
+					bRead <- Sample{ConnID: connID, N: int64(n)}
+				}
+			}
+			if err != nil {
+				ring.CloseWithError(err)
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, chunkSize)
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
 		default:
-			bufSize := nextStep * nextStep * int64(r)
-			bufSize = 409500
-			n, err := io.CopyN(rw, rw, bufSize)
-			if err != nil {
-				return err
+		}
+
+		n, err := ring.Read(buf)
+		if n > 0 {
+			if _, werr := sink.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
 			}
-			bRead <- int64(n)
+			return err
 		}
 	}
+}
 
-	return nil
+// openSink resolves the --out destination into an io.Writer. An empty
+// string discards everything written (the previous hardcoded behaviour);
+// "-" writes to stdout; tcp:// and unix:// URLs dial out to a listener; any
+// other value is treated as a file path to create. The returned io.Closer
+// is nil when there is nothing to close.
+func openSink(out string) (io.Writer, io.Closer, error) {
+	switch {
+	case out == "":
+		return ioutil.Discard, nil, nil
+	case out == "-":
+		return os.Stdout, nil, nil
+	case strings.HasPrefix(out, "tcp://"):
+		conn, err := net.Dial("tcp", strings.TrimPrefix(out, "tcp://"))
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, conn, nil
+	case strings.HasPrefix(out, "unix://"):
+		conn, err := net.Dial("unix", strings.TrimPrefix(out, "unix://"))
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, conn, nil
+	default:
+		f, err := os.Create(out)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, f, nil
+	}
 }
 
 // CalculateBandwidth keeps track of the amount of bytes read, and calculates a
 // per-second average as well as the average across the whole runtime of the program.
-func CalculateBandwidth(ctx context.Context, bRead chan int64) {
+// When more than one connection is feeding bRead, it also prints each
+// connection's subtotal alongside the global average.
+func CalculateBandwidth(ctx context.Context, bRead chan Sample) {
 	// no mutex required for these as only one of the select cases below
 	// can be running at a time
 	var total int64
 	var prevSecond int64
+	perConn := make(map[string]int64)
 	start := time.Now()
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
@@ -181,9 +592,10 @@ func CalculateBandwidth(ctx context.Context, bRead chan int64) {
 	go func() {
 		for {
 			select {
-			case n := <-bRead:
-				total += n
-				prevSecond += n
+			case s := <-bRead:
+				total += s.N
+				prevSecond += s.N
+				perConn[s.ConnID] += s.N
 			case _ = <-ticker.C:
 				elapsed := time.Since(start)
 				prevDesc := getUnits(prevSecond)
@@ -191,6 +603,12 @@ func CalculateBandwidth(ctx context.Context, bRead chan int64) {
 				avg := totalDesc.count / elapsed.Seconds()
 				fmt.Printf("\rcurrent: %.0f %v/s\t", prevDesc.count, prevDesc.desc)
 				fmt.Printf("average: %.4f %v/s", avg, totalDesc.desc)
+				if len(perConn) > 1 {
+					for connID, n := range perConn {
+						connDesc := getUnits(n)
+						fmt.Printf("\t[%s: %.0f %v]", connID, connDesc.count, connDesc.desc)
+					}
+				}
 				prevSecond = 0
 			}
 		}
@@ -203,6 +621,12 @@ func CalculateBandwidth(ctx context.Context, bRead chan int64) {
 		elapsed.Seconds(),
 		totalDesc.count,
 		totalDesc.desc)
+	if len(perConn) > 1 {
+		for connID, n := range perConn {
+			connDesc := getUnits(n)
+			fmt.Printf("  %s: %.0f %v\n", connID, connDesc.count, connDesc.desc)
+		}
+	}
 	return
 }
 
@@ -229,3 +653,33 @@ func reducer(remCount float64, descIdx int) unit {
 func getUnits(count int64) unit {
 	return reducer(float64(count), 0)
 }
+
+// parseSize parses a human-readable size such as "10KB", "1.5MB", or "2GB"
+// into a raw byte count, using the same unit table getUnits displays with.
+// A trailing "/s" (as in a rate like "10MB/s") is accepted and ignored, so
+// the same parser handles both plain sizes and rates symmetrically with the
+// display side.
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "/s")
+	if s == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+
+	upper := strings.ToUpper(s)
+	for i := len(descs) - 1; i >= 0; i-- {
+		desc := descs[i]
+		if !strings.HasSuffix(upper, desc) {
+			continue
+		}
+
+		numPart := strings.TrimSpace(s[:len(s)-len(desc)])
+		n, err := strconv.ParseFloat(numPart, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid size %q: %v", s, err)
+		}
+
+		return int64(n * math.Pow(nextStep, float64(i))), nil
+	}
+
+	return 0, fmt.Errorf("unrecognized size unit in %q", s)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// chunkSizeBuckets are the upper bounds (inclusive) used to bucket
+// bw_chunk_size_bytes observations for the Prometheus histogram.
+var chunkSizeBuckets = []int64{
+	1 << 10,  // 1 KB
+	1 << 16,  // 64 KB
+	1 << 20,  // 1 MB
+	10 << 20, // 10 MB
+	100 << 20,
+	1 << 30, // 1 GB
+}
+
+// metricsRegistry accumulates counters from Samples and serves them over
+// HTTP in Prometheus/OpenMetrics text exposition format. bucketCounts holds
+// cumulative counts keyed to chunkSizeBuckets (a sample of size s increments
+// every bucket i where chunkSizeBuckets[i] >= s, the usual cumulative
+// histogram convention), so a long-running process's memory and scrape cost
+// stay fixed regardless of how many samples it has seen.
+type metricsRegistry struct {
+	mu           sync.Mutex
+	bytesTotal   int64
+	observations int64
+	bucketCounts []int64
+	start        time.Time
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		start:        time.Now(),
+		bucketCounts: make([]int64, len(chunkSizeBuckets)),
+	}
+}
+
+// consume reads Samples from in, updating the registry's counters, until
+// ctx is cancelled.
+func (m *metricsRegistry) consume(ctx context.Context, in chan Sample) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case s := <-in:
+			m.mu.Lock()
+			m.bytesTotal += s.N
+			m.observations++
+			for i, bucket := range chunkSizeBuckets {
+				if s.N <= bucket {
+					m.bucketCounts[i]++
+				}
+			}
+			m.mu.Unlock()
+		}
+	}
+}
+
+// serve starts an HTTP server on addr exposing /metrics, shutting down when
+// ctx is cancelled.
+func (m *metricsRegistry) serve(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", m.handleMetrics)
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (m *metricsRegistry) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	total := m.bytesTotal
+	observations := m.observations
+	counts := append([]int64(nil), m.bucketCounts...)
+	elapsed := time.Since(m.start).Seconds()
+	m.mu.Unlock()
+
+	var bytesPerSecond float64
+	if elapsed > 0 {
+		bytesPerSecond = float64(total) / elapsed
+	}
+
+	fmt.Fprintf(w, "# HELP bw_bytes_total Total bytes read since start.\n")
+	fmt.Fprintf(w, "# TYPE bw_bytes_total counter\n")
+	fmt.Fprintf(w, "bw_bytes_total %d\n", total)
+
+	fmt.Fprintf(w, "# HELP bw_bytes_per_second Average bytes read per second since start.\n")
+	fmt.Fprintf(w, "# TYPE bw_bytes_per_second gauge\n")
+	fmt.Fprintf(w, "bw_bytes_per_second %f\n", bytesPerSecond)
+
+	fmt.Fprintf(w, "# HELP bw_chunk_size_bytes Size in bytes of each chunk read.\n")
+	fmt.Fprintf(w, "# TYPE bw_chunk_size_bytes histogram\n")
+	for i, bucket := range chunkSizeBuckets {
+		fmt.Fprintf(w, "bw_chunk_size_bytes_bucket{le=\"%d\"} %d\n", bucket, counts[i])
+	}
+	fmt.Fprintf(w, "bw_chunk_size_bytes_bucket{le=\"+Inf\"} %d\n", observations)
+	fmt.Fprintf(w, "bw_chunk_size_bytes_sum %d\n", total)
+	fmt.Fprintf(w, "bw_chunk_size_bytes_count %d\n", observations)
+}
+
+// pushStatsd reads Samples from in and pushes bw.bytes_total (counter) and
+// bw.bytes_per_second (gauge) to a StatsD daemon at addr over UDP once a
+// second, until ctx is cancelled.
+func pushStatsd(ctx context.Context, in chan Sample, addr string) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var total, prevSecond int64
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case s := <-in:
+			total += s.N
+			prevSecond += s.N
+		case <-ticker.C:
+			fmt.Fprintf(conn, "bw.bytes_total:%d|c\n", total)
+			fmt.Fprintf(conn, "bw.bytes_per_second:%d|g\n", prevSecond)
+			prevSecond = 0
+		}
+	}
+}
+
+// fanOut duplicates every Sample received on in to each of outs, so that
+// independent consumers (the stdout printer, the Prometheus registry, the
+// StatsD pusher) can each observe every increment without racing over a
+// single shared channel.
+func fanOut(ctx context.Context, in chan Sample, outs ...chan Sample) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case s := <-in:
+			for _, out := range outs {
+				select {
+				case out <- s:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// RingBuffer is a fixed-capacity circular byte buffer shared between a
+// single writer goroutine and a single reader goroutine. Write blocks while
+// the buffer is full and Read blocks while it is empty, so a slow reader
+// applies backpressure to the writer without either side needing to copy
+// the whole stream up front. Modeled on Arvados' asyncbuf.Buffer, but
+// bounded rather than growable, since ReadData only ever needs to hold
+// --mb worth of in-flight data.
+type RingBuffer struct {
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	buf      []byte
+	r, w     int
+	size     int
+	err      error
+}
+
+// NewRingBuffer returns a RingBuffer with room for capacity unread bytes.
+func NewRingBuffer(capacity int) *RingBuffer {
+	if capacity < 1 {
+		capacity = 1
+	}
+	rb := &RingBuffer{buf: make([]byte, capacity)}
+	rb.notEmpty = sync.NewCond(&rb.mu)
+	rb.notFull = sync.NewCond(&rb.mu)
+	return rb
+}
+
+// Write copies all of p into the ring, blocking while it is full, and wakes
+// any reader blocked in Read. It returns CloseWithError's error if the
+// buffer is closed while blocked.
+func (rb *RingBuffer) Write(p []byte) (int, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	written := 0
+	for written < len(p) {
+		for rb.size == len(rb.buf) && rb.err == nil {
+			rb.notFull.Wait()
+		}
+		if rb.err != nil {
+			return written, rb.err
+		}
+
+		first := min(len(p)-written, len(rb.buf)-rb.w)
+		n := min(first, len(rb.buf)-rb.size)
+		copy(rb.buf[rb.w:rb.w+n], p[written:written+n])
+
+		rb.w = (rb.w + n) % len(rb.buf)
+		rb.size += n
+		written += n
+		rb.notEmpty.Broadcast()
+	}
+
+	return written, nil
+}
+
+// Read copies up to len(p) unread bytes into p, blocking while the buffer
+// is empty. Once the buffer has drained, it returns the error passed to
+// CloseWithError (io.EOF on a clean end of stream).
+func (rb *RingBuffer) Read(p []byte) (int, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	for rb.size == 0 && rb.err == nil {
+		rb.notEmpty.Wait()
+	}
+	if rb.size == 0 {
+		return 0, rb.err
+	}
+
+	first := min(rb.size, len(rb.buf)-rb.r)
+	n := min(len(p), first)
+	copy(p[:n], rb.buf[rb.r:rb.r+n])
+
+	rb.r = (rb.r + n) % len(rb.buf)
+	rb.size -= n
+	rb.notFull.Broadcast()
+
+	return n, nil
+}
+
+// CloseWithError records err (io.EOF for a clean close) and wakes any
+// blocked reader or writer. Only the first call has an effect, so every
+// consumer observes the same terminal error exactly once, after any bytes
+// already buffered have been drained.
+func (rb *RingBuffer) CloseWithError(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if rb.err == nil {
+		rb.err = err
+	}
+	rb.notEmpty.Broadcast()
+	rb.notFull.Broadcast()
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
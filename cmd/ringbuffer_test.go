@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// TestRingBufferBackpressure spawns a fast producer against a slow reader
+// through a small ring buffer, and asserts both that every byte written
+// comes back out intact and that the producer was actually forced to wait
+// on the reader rather than racing ahead unbounded.
+func TestRingBufferBackpressure(t *testing.T) {
+	const capacity = 64
+	const total = 64 * 200 // far larger than capacity
+	const readChunk = 16
+
+	want := make([]byte, total)
+	for i := range want {
+		want[i] = byte(i)
+	}
+
+	rb := NewRingBuffer(capacity)
+
+	writeDone := make(chan struct{})
+	var writeElapsed time.Duration
+	start := time.Now()
+	go func() {
+		defer close(writeDone)
+		const writeChunk = 32
+		for i := 0; i < len(want); i += writeChunk {
+			end := i + writeChunk
+			if end > len(want) {
+				end = len(want)
+			}
+			if _, err := rb.Write(want[i:end]); err != nil {
+				t.Errorf("unexpected write error: %v", err)
+				return
+			}
+		}
+		rb.CloseWithError(io.EOF)
+		// time the producer alone, not the reader loop, so an unbounded
+		// buffer that let it race ahead would fail the check below
+		writeElapsed = time.Since(start)
+	}()
+
+	var got bytes.Buffer
+	buf := make([]byte, readChunk)
+	for {
+		n, err := rb.Read(buf)
+		got.Write(buf[:n])
+		if err != nil {
+			if err != io.EOF {
+				t.Fatalf("unexpected read error: %v", err)
+			}
+			break
+		}
+		// slow reader: forces the producer to block on backpressure once
+		// the ring fills up
+		time.Sleep(time.Millisecond)
+	}
+	<-writeDone
+	elapsed := writeElapsed
+
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Fatalf("got %d bytes, want %d bytes, contents differ", got.Len(), len(want))
+	}
+
+	minElapsed := time.Duration(total/readChunk) * time.Millisecond / 2
+	if elapsed < minElapsed {
+		t.Fatalf("producer finished in %v without waiting on the slow reader (capacity %d, total %d); backpressure not enforced", elapsed, capacity, total)
+	}
+}